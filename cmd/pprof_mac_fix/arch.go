@@ -0,0 +1,340 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// arch describes one of the CPU architectures pprof_mac_fix knows how to
+// patch: the Mach-O cpu type/subtype used to pick the right slice out of a
+// fat kernel binary, and the rewriter that knows how to assemble the
+// replacement psignal_internal argument setup and fix up the branch
+// displacements left behind by the rewrite.
+type arch struct {
+	name       string
+	cpuType    uint32
+	cpuSubType uint32
+	rewriter   rewriter
+}
+
+func (a *arch) String() string { return a.name }
+
+// rewriter supplies the architecture-specific pieces of fix.apply: the
+// instructions that load the arguments to psignal_internal, and the
+// fixups needed to keep branch and call displacements correct once code
+// has been moved around within bsd_ast.
+type rewriter interface {
+	// signalCall returns the instructions that zero the first two
+	// arguments to psignal_internal, load tlsOff from the thread-local
+	// storage base to form the third (thread) argument, set the fourth
+	// argument to the constant 4, and load sig into the last argument
+	// register. It does not include the call itself; the
+	// call instruction already present in bsd_ast is left untouched.
+	signalCall(tlsOff uint32, sig byte) []byte
+
+	// shortenCondJump subtracts n bytes from the displacement encoded in
+	// the conditional branch instruction occupying the end of code. It
+	// returns an error if code does not end in a conditional branch.
+	shortenCondJump(code []byte, n int) error
+
+	// shortenUncondJump subtracts n bytes from the displacement encoded
+	// in the unconditional branch instruction occupying the end of code.
+	// It returns an error if code does not end in an unconditional branch.
+	shortenUncondJump(code []byte, n int) error
+
+	// adjustCallDisp adjusts the displacement encoded in the call
+	// instruction occupying the end of code by delta bytes, to account
+	// for the call having moved by delta bytes within the function.
+	adjustCallDisp(code []byte, delta int) error
+
+	// nop returns the bytes of a single no-op instruction, used to pad
+	// the rewritten region out to its original size.
+	nop() []byte
+}
+
+var amd64Arch = &arch{
+	name:       "amd64",
+	cpuType:    0x01000007,
+	cpuSubType: 0x00000003,
+	rewriter:   amd64Rewriter{},
+}
+
+var arm64Arch = &arch{
+	name:       "arm64",
+	cpuType:    0x0100000c,
+	cpuSubType: 0x00000000, // CPU_SUBTYPE_ARM64_ALL
+	rewriter:   arm64Rewriter{},
+}
+
+var arches = []*arch{amd64Arch, arm64Arch}
+
+// archForCPU returns the arch matching the given Mach-O cpu type and
+// subtype, or nil if the pair is not one pprof_mac_fix knows how to patch.
+func archForCPU(cpuType, cpuSubType uint32) *arch {
+	for _, a := range arches {
+		if a.cpuType == cpuType && a.cpuSubType == cpuSubType {
+			return a
+		}
+	}
+	return nil
+}
+
+// amd64Rewriter implements rewriter for the x86-64 kernel.
+type amd64Rewriter struct{}
+
+func (amd64Rewriter) signalCall(tlsOff uint32, sig byte) []byte {
+	return []byte{
+		// xor %edi, %edi
+		0x31, 0xff,
+		// xor %esi, %esi
+		0x31, 0xf6,
+		// mov %gs:threadTLS, %rdx
+		0x65, 0x48, 0x8b, 0x14, 0x25,
+		byte(tlsOff), byte(tlsOff >> 8), byte(tlsOff >> 16), byte(tlsOff >> 24),
+		// mov $4, %ecx
+		0xb9, 0x04, 0x00, 0x00, 0x00,
+		// mov $sig, %r8d
+		0x41, 0xb8, sig, 0x00, 0x00, 0x00,
+	}
+}
+
+// decodeTrailingInst finds the x86 instruction occupying the last bytes
+// of code. x86 instructions are variable length and self-describing, so
+// it tries the (at most maxX86InstLen) candidate start offsets near the
+// end of code in increasing order and returns the first one whose decoded
+// length lands exactly on the end of code. More than one candidate can
+// land there (a shorter instruction decoded from the tail of a longer
+// one); the earliest start wins.
+const maxX86InstLen = 15
+
+func decodeTrailingInst(code []byte) (in x86asm.Inst, start int, err error) {
+	from := 0
+	if len(code) > maxX86InstLen {
+		from = len(code) - maxX86InstLen
+	}
+	for start = from; start < len(code); start++ {
+		in, err = x86asm.Decode(code[start:], 64)
+		if err == nil && start+in.Len == len(code) {
+			return in, start, nil
+		}
+	}
+	return x86asm.Inst{}, 0, fmt.Errorf("no instruction found ending at offset %d", len(code))
+}
+
+func isCondJump(op x86asm.Op) bool {
+	switch op {
+	case x86asm.JA, x86asm.JAE, x86asm.JB, x86asm.JBE, x86asm.JCXZ, x86asm.JE,
+		x86asm.JG, x86asm.JGE, x86asm.JL, x86asm.JLE, x86asm.JNE, x86asm.JNO,
+		x86asm.JNP, x86asm.JNS, x86asm.JO, x86asm.JP, x86asm.JRCXZ, x86asm.JS:
+		return true
+	}
+	return false
+}
+
+// adjustTrailingDisp subtracts n from the rel8 or rel32 displacement
+// trailing the decoded instruction in, which decodeTrailingInst found
+// starting at code[start:]. Every branch/call instruction this package
+// deals with encodes its displacement as the last 1 or 4 bytes of the
+// instruction; a 2-byte instruction (opcode + rel8) takes the 1-byte
+// form, everything longer (0F 8x + rel32, E9 + rel32, E8 + rel32) takes
+// the 4-byte form.
+func adjustTrailingDisp(code []byte, in x86asm.Inst, n int) error {
+	width := 4
+	if in.Len == 2 {
+		width = 1
+	}
+	if len(code) < width {
+		return fmt.Errorf("instruction too short for a %d-byte displacement", width)
+	}
+	tail := code[len(code)-width:]
+	if width == 1 {
+		tail[0] -= byte(n)
+	} else {
+		le.PutUint32(tail, le.Uint32(tail)-uint32(n))
+	}
+	return nil
+}
+
+func (amd64Rewriter) shortenCondJump(code []byte, n int) error {
+	in, _, err := decodeTrailingInst(code)
+	if err != nil || !isCondJump(in.Op) {
+		return fmt.Errorf("missing conditional jump")
+	}
+	return adjustTrailingDisp(code, in, n)
+}
+
+func (amd64Rewriter) shortenUncondJump(code []byte, n int) error {
+	in, _, err := decodeTrailingInst(code)
+	if err != nil || in.Op != x86asm.JMP {
+		return fmt.Errorf("missing unconditional jump")
+	}
+	return adjustTrailingDisp(code, in, n)
+}
+
+func (amd64Rewriter) adjustCallDisp(code []byte, delta int) error {
+	in, _, err := decodeTrailingInst(code)
+	if err != nil || in.Op != x86asm.CALL {
+		return fmt.Errorf("missing call instruction")
+	}
+	return adjustTrailingDisp(code, in, delta)
+}
+
+func (amd64Rewriter) nop() []byte { return []byte{0x90} }
+
+// templateRewriter overrides signalCall with a byte template supplied by a
+// -fixes entry (see parseSignalCallTemplate in fixload.go), for a kernel
+// whose psignal_internal argument setup differs from the arch's built-in
+// convention. The branch/call fixups and nop padding are facts about the
+// arch's instruction set, not about any one kernel's calling convention,
+// so those still come from the underlying rewriter.
+type templateRewriter struct {
+	rewriter
+	tmpl     []byte
+	tlsOffAt int
+	sigAt    int
+}
+
+func (t templateRewriter) signalCall(tlsOff uint32, sig byte) []byte {
+	code := append([]byte(nil), t.tmpl...)
+	le.PutUint32(code[t.tlsOffAt:], tlsOff)
+	code[t.sigAt] = sig
+	return code
+}
+
+// arm64Rewriter implements rewriter for the ARM64 kernel. The instruction
+// sequences mirror the amd64 ones: zero the unused psignal_internal
+// arguments, form the thread argument from the TLS base plus tlsOff, and
+// load the signal number. The call to psignal_internal itself, like the
+// call on amd64, is left in place after the rewritten region and is not
+// reassembled here.
+type arm64Rewriter struct{}
+
+// ARM64 register numbers used by the generated sequence.
+const (
+	arm64RegArg0  = 0 // x0: first argument (zeroed)
+	arm64RegArg1  = 1 // x1: second argument (zeroed)
+	arm64RegTLS   = 2 // x2: tls base -> thread pointer
+	arm64RegArg3  = 3 // x3: code (constant 4)
+	arm64RegArg4  = 4 // x4: signal number
+	arm64RegScrat = 9 // x9: scratch for building tlsOff
+)
+
+func arm64Insn(word uint32) []byte {
+	return []byte{byte(word), byte(word >> 8), byte(word >> 16), byte(word >> 24)}
+}
+
+// arm64Movz encodes "movz Xd, #imm16, lsl #0".
+func arm64Movz(rd int, imm16 uint16) uint32 {
+	return 0xd2800000 | uint32(imm16)<<5 | uint32(rd)
+}
+
+// arm64Movk encodes "movk Xd, #imm16, lsl #16".
+func arm64Movk(rd int, imm16 uint16) uint32 {
+	return 0xf2a00000 | uint32(imm16)<<5 | uint32(rd)
+}
+
+// arm64Mrs encodes "mrs Xd, tpidrro_el0", the register xnu uses to hold
+// the per-thread data pointer on arm64.
+func arm64Mrs(rd int) uint32 {
+	return 0xd53bd060 | uint32(rd)
+}
+
+// arm64Add encodes "add Xd, Xn, Xm", used to add the scratch-built
+// tlsOff to the TLS base.
+func arm64Add(rd, rn, rm int) uint32 {
+	return 0x8b000000 | uint32(rm)<<16 | uint32(rn)<<5 | uint32(rd)
+}
+
+func (arm64Rewriter) signalCall(tlsOff uint32, sig byte) []byte {
+	var code []byte
+	emit := func(word uint32) { code = append(code, arm64Insn(word)...) }
+
+	emit(arm64Movz(arm64RegArg0, 0))                        // mov x0, #0
+	emit(arm64Movz(arm64RegArg1, 0))                        // mov x1, #0
+	emit(arm64Mrs(arm64RegTLS))                             // mrs x2, tpidrro_el0
+	emit(arm64Movz(arm64RegScrat, uint16(tlsOff)))          // mov x9, #tlsOff@lo
+	emit(arm64Movk(arm64RegScrat, uint16(tlsOff>>16)))      // movk x9, #tlsOff@hi, lsl #16
+	emit(arm64Add(arm64RegTLS, arm64RegTLS, arm64RegScrat)) // add x2, x2, x9
+	emit(arm64Movz(arm64RegArg3, 4))                        // mov x3, #4
+	emit(arm64Movz(arm64RegArg4, uint16(sig)))              // mov x4, #sig
+	return code
+}
+
+// arm64CondBranch reports whether the last instruction in code is a
+// conditional branch (B.cond or CBZ/CBNZ, which all place a 19-bit
+// instruction-counted displacement at bits [23:5]) and, if so, returns
+// the instruction word and its offset in code.
+func arm64CondBranch(code []byte) (insn uint32, off int, ok bool) {
+	if len(code) < 4 {
+		return 0, 0, false
+	}
+	off = len(code) - 4
+	insn = le.Uint32(code[off:])
+	switch {
+	case insn&0xff000010 == 0x54000000: // B.cond
+	case insn&0x7e000000 == 0x34000000: // CBZ/CBNZ
+	default:
+		return 0, 0, false
+	}
+	return insn, off, true
+}
+
+func (arm64Rewriter) shortenCondJump(code []byte, n int) error {
+	insn, off, ok := arm64CondBranch(code)
+	if !ok {
+		return fmt.Errorf("missing conditional branch")
+	}
+	if n%4 != 0 {
+		return fmt.Errorf("branch adjustment %d not instruction-aligned", n)
+	}
+	imm19 := int32(insn<<8) >> 13
+	imm19 -= int32(n / 4)
+	insn = (insn &^ (0x7ffff << 5)) | (uint32(imm19) & 0x7ffff << 5)
+	le.PutUint32(code[off:], insn)
+	return nil
+}
+
+func (arm64Rewriter) shortenUncondJump(code []byte, n int) error {
+	if len(code) < 4 {
+		return fmt.Errorf("missing unconditional branch")
+	}
+	off := len(code) - 4
+	insn := le.Uint32(code[off:])
+	if insn&0xfc000000 != 0x14000000 {
+		return fmt.Errorf("missing unconditional branch")
+	}
+	if n%4 != 0 {
+		return fmt.Errorf("branch adjustment %d not instruction-aligned", n)
+	}
+	imm26 := int32(insn<<6) >> 6
+	imm26 -= int32(n / 4)
+	insn = (insn &^ 0x3ffffff) | (uint32(imm26) & 0x3ffffff)
+	le.PutUint32(code[off:], insn)
+	return nil
+}
+
+func (arm64Rewriter) nop() []byte { return []byte{0x1f, 0x20, 0x03, 0xd5} }
+
+func (arm64Rewriter) adjustCallDisp(code []byte, delta int) error {
+	if len(code) < 4 {
+		return fmt.Errorf("missing call instruction")
+	}
+	off := len(code) - 4
+	insn := le.Uint32(code[off:])
+	if insn&0xfc000000 != 0x94000000 {
+		return fmt.Errorf("missing BL instruction")
+	}
+	if delta%4 != 0 {
+		return fmt.Errorf("call adjustment %d not instruction-aligned", delta)
+	}
+	imm26 := int32(insn<<6) >> 6
+	imm26 -= int32(delta / 4)
+	insn = (insn &^ 0x3ffffff) | (uint32(imm26) & 0x3ffffff)
+	le.PutUint32(code[off:], insn)
+	return nil
+}
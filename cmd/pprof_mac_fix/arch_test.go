@@ -0,0 +1,204 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestArchForCPU(t *testing.T) {
+	tests := []struct {
+		cpuType, cpuSubType uint32
+		want                *arch
+	}{
+		{amd64Arch.cpuType, amd64Arch.cpuSubType, amd64Arch},
+		{arm64Arch.cpuType, arm64Arch.cpuSubType, arm64Arch},
+		{amd64Arch.cpuType, 0xdead, nil}, // right type, wrong subtype
+		{0xdead, amd64Arch.cpuSubType, nil},
+	}
+	for _, tt := range tests {
+		if got := archForCPU(tt.cpuType, tt.cpuSubType); got != tt.want {
+			t.Errorf("archForCPU(%#x, %#x) = %v, want %v", tt.cpuType, tt.cpuSubType, got, tt.want)
+		}
+	}
+}
+
+// arm64BCond encodes "b.eq" with the given imm19 (in units of instructions).
+func arm64BCond(imm19 int32) uint32 {
+	return 0x54000000 | (uint32(imm19)&0x7ffff)<<5
+}
+
+// arm64B encodes an unconditional "b" with the given imm26.
+func arm64B(imm26 int32) uint32 {
+	return 0x14000000 | uint32(imm26)&0x3ffffff
+}
+
+// arm64BL encodes a "bl" with the given imm26.
+func arm64BL(imm26 int32) uint32 {
+	return 0x94000000 | uint32(imm26)&0x3ffffff
+}
+
+func TestArm64ShortenCondJump(t *testing.T) {
+	code := arm64Insn(arm64BCond(10))
+	if err := (arm64Rewriter{}).shortenCondJump(code, 16); err != nil {
+		t.Fatalf("shortenCondJump: %v", err)
+	}
+	insn := le.Uint32(code)
+	imm19 := int32(insn<<8) >> 13
+	if imm19 != 6 { // 10 instructions - 16/4 = 6
+		t.Errorf("imm19 = %d, want 6", imm19)
+	}
+
+	if err := (arm64Rewriter{}).shortenCondJump(code, 3); err == nil {
+		t.Errorf("shortenCondJump with unaligned delta: got nil error, want one")
+	}
+
+	if err := (arm64Rewriter{}).shortenCondJump([]byte{0, 0, 0, 0}, 4); err == nil {
+		t.Errorf("shortenCondJump on a non-branch word: got nil error, want one")
+	}
+}
+
+func TestArm64ShortenCondJumpCBZ(t *testing.T) {
+	// CBZ w8, +imm19 places its immediate at the same bits as B.cond, so
+	// arm64CondBranch (and hence shortenCondJump) must accept it too.
+	cbz := uint32(0x34000000) | (uint32(5)&0x7ffff)<<5 | 8 // cbz w8, #5
+	code := arm64Insn(cbz)
+	if err := (arm64Rewriter{}).shortenCondJump(code, 8); err != nil {
+		t.Fatalf("shortenCondJump(cbz): %v", err)
+	}
+	insn := le.Uint32(code)
+	imm19 := int32(insn<<8) >> 13
+	if imm19 != 3 { // 5 - 8/4 = 3
+		t.Errorf("imm19 = %d, want 3", imm19)
+	}
+}
+
+func TestArm64ShortenUncondJump(t *testing.T) {
+	code := arm64Insn(arm64B(20))
+	if err := (arm64Rewriter{}).shortenUncondJump(code, 32); err != nil {
+		t.Fatalf("shortenUncondJump: %v", err)
+	}
+	insn := le.Uint32(code)
+	imm26 := int32(insn<<6) >> 6
+	if imm26 != 12 { // 20 - 32/4 = 12
+		t.Errorf("imm26 = %d, want 12", imm26)
+	}
+}
+
+func TestArm64AdjustCallDisp(t *testing.T) {
+	code := arm64Insn(arm64BL(100))
+	if err := (arm64Rewriter{}).adjustCallDisp(code, -40); err != nil {
+		t.Fatalf("adjustCallDisp: %v", err)
+	}
+	insn := le.Uint32(code)
+	imm26 := int32(insn<<6) >> 6
+	if imm26 != 110 { // 100 - (-40/4) = 100 + 10 = 110
+		t.Errorf("imm26 = %d, want 110", imm26)
+	}
+}
+
+func TestAmd64ShortenCondJumpRel8(t *testing.T) {
+	// Leading junk bytes make sure decodeTrailingInst has to search back
+	// from the end of code rather than assuming the jump starts at 0.
+	code := []byte{0x90, 0x90, 0x75, 40} // jne rel8, disp=40
+	if err := (amd64Rewriter{}).shortenCondJump(code, 16); err != nil {
+		t.Fatalf("shortenCondJump: %v", err)
+	}
+	if code[3] != 24 { // 40 - 16 = 24
+		t.Errorf("disp = %d, want 24", code[3])
+	}
+}
+
+func TestAmd64ShortenCondJumpRel32(t *testing.T) {
+	code := []byte{0x0f, 0x85, 0, 0, 0, 0} // jne rel32
+	le.PutUint32(code[2:], 100)
+	if err := (amd64Rewriter{}).shortenCondJump(code, 16); err != nil {
+		t.Fatalf("shortenCondJump: %v", err)
+	}
+	if disp := le.Uint32(code[2:]); disp != 84 { // 100 - 16 = 84
+		t.Errorf("disp = %d, want 84", disp)
+	}
+
+	if err := (amd64Rewriter{}).shortenCondJump([]byte{0xe9, 0, 0, 0, 0}, 4); err == nil {
+		t.Errorf("shortenCondJump on jmp (unconditional): got nil error, want one")
+	}
+	if err := (amd64Rewriter{}).shortenCondJump([]byte{0x0f}, 4); err == nil {
+		t.Errorf("shortenCondJump on undecodable bytes: got nil error, want one")
+	}
+}
+
+func TestAmd64ShortenUncondJump(t *testing.T) {
+	code := []byte{0xe9, 0, 0, 0, 0} // jmp rel32
+	le.PutUint32(code[1:], 200)
+	if err := (amd64Rewriter{}).shortenUncondJump(code, 40); err != nil {
+		t.Fatalf("shortenUncondJump: %v", err)
+	}
+	if disp := le.Uint32(code[1:]); disp != 160 { // 200 - 40 = 160
+		t.Errorf("disp = %d, want 160", disp)
+	}
+
+	if err := (amd64Rewriter{}).shortenUncondJump([]byte{0x75, 0}, 4); err == nil {
+		t.Errorf("shortenUncondJump on jne (conditional): got nil error, want one")
+	}
+}
+
+func TestAmd64AdjustCallDisp(t *testing.T) {
+	code := []byte{0xe8, 0, 0, 0, 0} // call rel32
+	le.PutUint32(code[1:], 500)
+	if err := (amd64Rewriter{}).adjustCallDisp(code, -40); err != nil {
+		t.Fatalf("adjustCallDisp: %v", err)
+	}
+	if disp := le.Uint32(code[1:]); disp != 540 { // 500 - (-40) = 540
+		t.Errorf("disp = %d, want 540", disp)
+	}
+
+	if err := (amd64Rewriter{}).adjustCallDisp([]byte{0xe9, 0, 0, 0, 0}, 4); err == nil {
+		t.Errorf("adjustCallDisp on jmp (not a call): got nil error, want one")
+	}
+}
+
+func TestAmd64Nop(t *testing.T) {
+	if got := (amd64Rewriter{}).nop(); !bytes.Equal(got, []byte{0x90}) {
+		t.Errorf("nop() = % x, want 90", got)
+	}
+}
+
+func TestAmd64SignalCall(t *testing.T) {
+	const tlsOff = 0x0001b000
+	const sig = 0x1a
+	code := (amd64Rewriter{}).signalCall(tlsOff, sig)
+	// xor %edi,%edi; xor %esi,%esi; mov %gs:tlsOff,%rdx; mov $4,%ecx; mov $sig,%r8d
+	if len(code) != 2+2+9+5+6 {
+		t.Fatalf("signalCall produced %d bytes, want %d", len(code), 2+2+9+5+6)
+	}
+	if got := le.Uint32(code[2+2+5:]); got != tlsOff {
+		t.Errorf("tlsOff = %#x, want %#x", got, tlsOff)
+	}
+	if got := code[2+2+9+5+2]; got != sig {
+		t.Errorf("sig = %#x, want %#x", got, sig)
+	}
+}
+
+func TestArm64SignalCallRoundTrip(t *testing.T) {
+	const tlsOff = 0x0001b000
+	const sig = 0x1a
+	code := (arm64Rewriter{}).signalCall(tlsOff, sig)
+	if len(code)%4 != 0 {
+		t.Fatalf("signalCall produced %d bytes, not a whole number of arm64 instructions", len(code))
+	}
+	// The tlsOff low/high halves are built with movz/movk into x9; make
+	// sure both immediate halves round-trip through the encoding.
+	lo := le.Uint32(code[3*4:]) >> 5 & 0xffff
+	hi := le.Uint32(code[4*4:]) >> 5 & 0xffff
+	got := uint32(lo) | uint32(hi)<<16
+	if got != tlsOff {
+		t.Errorf("tlsOff round-tripped as %#x, want %#x", got, tlsOff)
+	}
+	sigGot := le.Uint32(code[len(code)-4:]) >> 5 & 0xffff
+	if sigGot != sig {
+		t.Errorf("sig round-tripped as %#x, want %#x", sigGot, sig)
+	}
+}
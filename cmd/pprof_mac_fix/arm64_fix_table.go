@@ -0,0 +1,66 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Darwin 20.1.0 (Big Sur, arm64)
+//
+// Unlike the amd64 patterns in main.go, these stay on the masked-byte
+// pattern matcher: x86asm.Decode only understands x86, so there is no
+// decoder to build an instPattern on top of here.
+//
+// current_thread is not inlined the same way as on amd64: the per-thread
+// data pointer comes from tpidrro_el0 rather than %gs, but the shape gdb
+// shows (load, then leave) mirrors current_thread_leave in main.go.
+//
+// NOTE: this table entry has not been captured from a real kernel the way
+// the amd64 ones in main.go were (see the -dump / "mail rsc@golang.org" note
+// in the package doc) -- nobody has run pprof_mac_fix against Apple
+// Silicon hardware yet. It exists to exercise the arch/rewriter plumbing
+// end to end; treat the exact byte patterns as a placeholder to be
+// replaced with a real capture once one is available.
+
+var current_thread_arm64_leave = mustCompile(`
+    0xfd 0x7b 0xbf 0xa9             //  0   stp x29, x30, [sp, #-16]!
+    0xfd 0x03 0x00 0x91             //  4   mov x29, sp
+    0x60 0xd0 0x3b 0xd5             //  8   mrs x0, tpidrro_el0
+    * 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    0xfd 0x7b 0xc1 0xa8             // 16   ldp x29, x30, [sp], #16
+    0xc0 0x03 0x5f 0xd6             // 20   ret
+`)
+
+// bsd_ast_20_1_0_arm64 mirrors the amd64 bsd_ast timer pattern: a header
+// that checks the pending vtimer flags and branches to either a
+// task_vtimer_set or task_vtimer_clear call, followed by the signal
+// delivery setup that pprof_mac_fix replaces with the correct argument
+// sequence for psignal_internal.
+var bsd_ast_20_1_0_arm64 = mustCompile(`
+    0xf7 0x03 0x00 0xaa                       //  0  mov x23, x0
+    0x00/0x00 0x00/0x00 0x00/0x00 0xf9/0xff   //  4  ldr x8, [x0, #0x1b0]
+    0x08/0x1f 0x00/0x00 0x00/0x00 0x34/0xff   //  8  cbz w8, +20 [28]
+    * 0xe0 0x62 0x00 0x91                     // 12  add x0, x23, #0x18
+    0x21 0x00 0x80 0xd2                       // 16  movz x1, #0x1
+    *                                         // 20
+    0x00/0x00 0x00/0x00 0x00/0x00 0x94/0xfc   // 20  bl task_vtimer_set
+    0x00/0x00 0x00/0x00 0x00/0x00 0x14/0xfc   // 24  b +16 [40]
+    * 0xe0 0x62 0x00 0x91                     // 28  add x0, x23, #0x18
+    0x21 0x00 0x80 0xd2                       // 32  movz x1, #0x1
+    *                                         // 36
+    0x00/0x00 0x00/0x00 0x00/0x00 0x94/0xfc   // 36  bl task_vtimer_clear
+    * 0x00/0x00 * 0x1a/0xfe 0x00/0x00 0x00/0x00   // 40  (replaced: signal setup)
+    0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
+    *                                         // 64
+    0x00/0x00 0x00/0x00 0x00/0x00 0x94/0xfc   // 64  bl psignal_internal
+`)
+
+var fix_20_1_0_arm64 = fix{
+	arch:           arm64Arch,
+	version:        "20.1.0",
+	current_thread: current_thread_arm64_leave,
+	bsd_ast:        []bsdPattern{bsd_ast_20_1_0_arm64},
+}
@@ -0,0 +1,163 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// fixesFlag names a JSON file of additional fix definitions, so that a new
+// Darwin kernel can be supported without editing fixes in main.go and
+// rebuilding. Run "pprof_mac_fix -dump oldkernel" to get the disassembly
+// needed to author one; see fixFile for the schema.
+var fixesFlag = flag.String("fixes", "", "JSON file of additional fix definitions (see fixFile)")
+
+// fixFile is the schema for a -fixes file: a list of fix definitions to
+// add to the built-in table. Each entry corresponds one-to-one with a fix
+// value, with the current_thread and bsd_ast patterns written in the
+// mark/value/mask text format compilePattern parses -- the same format
+// the arm64 fix in arm64_fix_table.go is built from. The amd64 fixes built into the
+// binary have since moved to instPattern (see instpattern.go), which has
+// no convenient JSON spelling, so a -fixes file always produces
+// pattern-matched fixes regardless of arch; that's a strictly weaker
+// matcher than instPattern, but it's enough to get a new kernel working
+// without a rebuild, and the entry can be upstreamed as an instPattern
+// later the way the built-in amd64 fixes now are.
+//
+// SignalCall is optional and lets an entry override the arch's built-in
+// psignal_internal argument setup: a kernel whose bsd_ast inlines that
+// setup with a different register assignment, or a different constant in
+// place of the "code" argument, would otherwise need a new Go rewriter
+// and a rebuild, the one thing -fixes exists to avoid. It is written in
+// the same text format as a pattern, plus two placeholder tokens:
+// "$tlsOff" (reserves the 4-byte thread-local offset filled in at patch
+// time) and "$sig" (reserves the 1-byte signal number from m[5]). Both
+// are required exactly once. If empty, the entry uses the arch's default
+// rewriter, the same one the built-in fixes use.
+type fixFile struct {
+	Fixes []fixEntry `json:"fixes"`
+}
+
+type fixEntry struct {
+	Version       string   `json:"version"`
+	Arch          string   `json:"arch"` // "amd64" or "arm64"
+	CurrentThread string   `json:"current_thread"`
+	BsdAst        []string `json:"bsd_ast"`
+	SignalCall    string   `json:"signal_call,omitempty"`
+}
+
+// archByName looks up one of the architectures pprof_mac_fix knows how to
+// patch by the name used in a fixFile.
+func archByName(name string) *arch {
+	for _, a := range arches {
+		if a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// parseSignalCallTemplate parses the text format described in fixFile's
+// doc comment into the raw bytes of a signal-call template plus the
+// offsets of its two placeholders.
+func parseSignalCallTemplate(text string) (tmpl []byte, tlsOffAt, sigAt int, err error) {
+	text = commentRE.ReplaceAllString(text, "")
+	tlsOffAt, sigAt = -1, -1
+	for _, f := range strings.Fields(text) {
+		switch f {
+		case "$tlsOff":
+			if tlsOffAt >= 0 {
+				return nil, 0, 0, fmt.Errorf("$tlsOff placeholder appears more than once")
+			}
+			tlsOffAt = len(tmpl)
+			tmpl = append(tmpl, 0, 0, 0, 0)
+			continue
+		case "$sig":
+			if sigAt >= 0 {
+				return nil, 0, 0, fmt.Errorf("$sig placeholder appears more than once")
+			}
+			sigAt = len(tmpl)
+			tmpl = append(tmpl, 0)
+			continue
+		}
+		v, err := strconv.ParseUint(f, 0, 8)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("invalid byte %q", f)
+		}
+		tmpl = append(tmpl, byte(v))
+	}
+	if tlsOffAt < 0 {
+		return nil, 0, 0, fmt.Errorf("missing $tlsOff placeholder")
+	}
+	if sigAt < 0 {
+		return nil, 0, 0, fmt.Errorf("missing $sig placeholder")
+	}
+	return tmpl, tlsOffAt, sigAt, nil
+}
+
+// loadFixFile reads and parses a -fixes file, compiling each entry's
+// patterns and returning the resulting fixes in file order. It does not
+// touch the built-in fixes table; the caller decides how to combine them.
+func loadFixFile(path string) ([]*fix, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ff fixFile
+	if err := json.Unmarshal(data, &ff); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var out []*fix
+	for i, e := range ff.Fixes {
+		a := archByName(e.Arch)
+		if a == nil {
+			return nil, fmt.Errorf("%s: fix %d (%s): unknown arch %q", path, i, e.Version, e.Arch)
+		}
+		ct, err := compilePattern(e.CurrentThread)
+		if err != nil {
+			return nil, fmt.Errorf("%s: fix %d (%s): current_thread: %v", path, i, e.Version, err)
+		}
+		if len(e.BsdAst) == 0 {
+			return nil, fmt.Errorf("%s: fix %d (%s): bsd_ast: at least one pattern required", path, i, e.Version)
+		}
+		var bsdAst []bsdPattern
+		for j, text := range e.BsdAst {
+			p, err := compilePattern(text)
+			if err != nil {
+				return nil, fmt.Errorf("%s: fix %d (%s): bsd_ast[%d]: %v", path, i, e.Version, j, err)
+			}
+			bsdAst = append(bsdAst, p)
+		}
+
+		fixArch := a
+		if e.SignalCall != "" {
+			tmpl, tlsOffAt, sigAt, err := parseSignalCallTemplate(e.SignalCall)
+			if err != nil {
+				return nil, fmt.Errorf("%s: fix %d (%s): signal_call: %v", path, i, e.Version, err)
+			}
+			fixArch = &arch{
+				name:       a.name,
+				cpuType:    a.cpuType,
+				cpuSubType: a.cpuSubType,
+				rewriter:   templateRewriter{rewriter: a.rewriter, tmpl: tmpl, tlsOffAt: tlsOffAt, sigAt: sigAt},
+			}
+		}
+
+		out = append(out, &fix{
+			arch:           fixArch,
+			version:        e.Version,
+			current_thread: ct,
+			bsd_ast:        bsdAst,
+		})
+	}
+	return out, nil
+}
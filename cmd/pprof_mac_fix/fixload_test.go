@@ -0,0 +1,62 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseSignalCallTemplate(t *testing.T) {
+	tmpl, tlsOffAt, sigAt, err := parseSignalCallTemplate(`
+		0x31 0xff                          // xor %edi,%edi
+		0x65 0x48 0x8b 0x14 0x25 $tlsOff   // mov %gs:tlsOff,%rdx
+		0x41 0xb8 $sig 0x00 0x00 0x00      // mov $sig,%r8d
+	`)
+	if err != nil {
+		t.Fatalf("parseSignalCallTemplate: %v", err)
+	}
+	if len(tmpl) != 2+9+6 {
+		t.Fatalf("tmpl has %d bytes, want %d", len(tmpl), 2+9+6)
+	}
+	if tlsOffAt != 2+5 {
+		t.Errorf("tlsOffAt = %d, want %d", tlsOffAt, 2+5)
+	}
+	if sigAt != 2+9+2 {
+		t.Errorf("sigAt = %d, want %d", sigAt, 2+9+2)
+	}
+
+	if _, _, _, err := parseSignalCallTemplate("0x90"); err == nil {
+		t.Errorf("template missing both placeholders: got nil error, want one")
+	}
+	if _, _, _, err := parseSignalCallTemplate("$tlsOff"); err == nil {
+		t.Errorf("template missing $sig: got nil error, want one")
+	}
+	if _, _, _, err := parseSignalCallTemplate("$tlsOff $tlsOff $sig"); err == nil {
+		t.Errorf("template with $tlsOff repeated: got nil error, want one")
+	}
+	if _, _, _, err := parseSignalCallTemplate("$tlsOff $sig $sig"); err == nil {
+		t.Errorf("template with $sig repeated: got nil error, want one")
+	}
+}
+
+func TestTemplateRewriterSignalCall(t *testing.T) {
+	tmpl, tlsOffAt, sigAt, err := parseSignalCallTemplate(`
+		0x65 0x48 0x8b 0x14 0x25 $tlsOff
+		0x41 0xb8 $sig 0x00 0x00 0x00
+	`)
+	if err != nil {
+		t.Fatalf("parseSignalCallTemplate: %v", err)
+	}
+	rw := templateRewriter{rewriter: amd64Rewriter{}, tmpl: tmpl, tlsOffAt: tlsOffAt, sigAt: sigAt}
+	code := rw.signalCall(0x1b000, 0x1a)
+	if got := le.Uint32(code[tlsOffAt:]); got != 0x1b000 {
+		t.Errorf("tlsOff = %#x, want %#x", got, 0x1b000)
+	}
+	if code[sigAt] != 0x1a {
+		t.Errorf("sig = %#x, want 0x1a", code[sigAt])
+	}
+	// The embedded rewriter still supplies nop/shortenCondJump/etc.
+	if got, want := string(rw.nop()), string(amd64Rewriter{}.nop()); got != want {
+		t.Errorf("nop() = % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "golang.org/x/arch/x86/x86asm"
+
+// bsdPattern is the common interface between pattern, which matches raw
+// bytes against per-nibble masks, and instPattern, which matches a
+// decoded x86 instruction stream. fix.apply is written against this
+// interface so that the amd64 fixes (instPattern) and the arm64 fix
+// (pattern -- there is no x86asm decoder to reach for there) share one
+// code path.
+type bsdPattern interface {
+	findAll(data []byte) []int
+	matchStart(data []byte, off int) []int
+}
+
+// instPattern matches a sequence of decoded x86 instructions, rather than
+// matching raw bytes against per-nibble masks the way pattern does.
+// Matching on the decoded instruction stream means a change in how the
+// compiler encodes an instruction -- a different register allocation, an
+// immediate that grows past 8 bits -- no longer requires a new mustCompile
+// byte literal, and the matcher can never match across an instruction
+// boundary, because it only ever advances whole instructions at a time.
+type instPattern struct {
+	steps []instStep
+}
+
+// instStep is one instruction an instPattern expects next in the stream.
+// mark records the instruction's start offset; markImm records the
+// offset of its trailing 4-byte immediate or displacement field (the
+// encoding used for every constant this package needs to read out of or
+// write into a matched instruction). A step may set both.
+type instStep struct {
+	op      x86asm.Op
+	mark    bool
+	markImm bool
+}
+
+func step(op x86asm.Op) instStep         { return instStep{op: op} }
+func markStep(op x86asm.Op) instStep     { return instStep{op: op, mark: true} }
+func markImmStep(op x86asm.Op) instStep  { return instStep{op: op, markImm: true} }
+func markBothStep(op x86asm.Op) instStep { return instStep{op: op, mark: true, markImm: true} }
+
+func insts(steps ...instStep) *instPattern { return &instPattern{steps: steps} }
+
+// findAll returns the offsets in data at which the pattern matches,
+// scanning forward one decoded instruction at a time the way
+// pattern.findAll scans forward one byte at a time.
+func (p *instPattern) findAll(data []byte) []int {
+	var out []int
+	for i := 0; i < len(data); {
+		in, err := x86asm.Decode(data[i:], 64)
+		if err != nil || in.Len == 0 {
+			i++
+			continue
+		}
+		if p.matchStart(data, i) != nil {
+			out = append(out, i)
+		}
+		i += in.Len
+	}
+	return out
+}
+
+// matchStart reports whether the pattern matches the instruction stream
+// starting at data[off:], returning the byte offsets recorded by each
+// mark/markImm step, in the order the steps appear in the pattern.
+func (p *instPattern) matchStart(data []byte, off int) []int {
+	marks := []int{}
+	i := off
+	for _, st := range p.steps {
+		if i >= len(data) {
+			return nil
+		}
+		in, err := x86asm.Decode(data[i:], 64)
+		if err != nil || in.Op != st.op {
+			return nil
+		}
+		if st.mark {
+			marks = append(marks, i)
+		}
+		if st.markImm {
+			if in.Len < 4 {
+				return nil
+			}
+			marks = append(marks, i+in.Len-4)
+		}
+		i += in.Len
+	}
+	return marks
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// push %rbp; xor %edi,%edi; mov $4,%ecx; ret
+var instPatternTestCode = []byte{
+	0x55,       // push %rbp
+	0x31, 0xff, // xor %edi,%edi
+	0xb9, 0x04, 0x00, 0x00, 0x00, // mov $4,%ecx
+	0xc3, // ret
+}
+
+func TestInstPatternMatchStart(t *testing.T) {
+	p := insts(markStep(x86asm.PUSH), step(x86asm.XOR), markImmStep(x86asm.MOV))
+	marks := p.matchStart(instPatternTestCode, 0)
+	want := []int{0, 4}
+	if !reflect.DeepEqual(marks, want) {
+		t.Fatalf("matchStart = %v, want %v", marks, want)
+	}
+}
+
+func TestInstPatternFindAll(t *testing.T) {
+	p := insts(markStep(x86asm.PUSH), step(x86asm.XOR), markImmStep(x86asm.MOV))
+	got := p.findAll(instPatternTestCode)
+	want := []int{0}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("findAll = %v, want %v", got, want)
+	}
+}
+
+func TestInstPatternOpcodeMismatch(t *testing.T) {
+	// The second step expects XOR; the code has PUSH, PUSH, ... so it
+	// should not match starting at offset 0.
+	code := []byte{0x55, 0x55, 0xc3}
+	p := insts(step(x86asm.PUSH), step(x86asm.XOR))
+	if marks := p.matchStart(code, 0); marks != nil {
+		t.Fatalf("matchStart = %v, want nil (opcode mismatch)", marks)
+	}
+	if got := p.findAll(code); got != nil {
+		t.Fatalf("findAll = %v, want nil", got)
+	}
+}
+
+func TestInstPatternMarkImmTooShort(t *testing.T) {
+	// push %rbp is a 1-byte instruction; markImmStep requires at least 4
+	// bytes to find a trailing immediate, so it must fail rather than
+	// read past the instruction.
+	p := insts(markImmStep(x86asm.PUSH))
+	if marks := p.matchStart(instPatternTestCode, 0); marks != nil {
+		t.Fatalf("matchStart = %v, want nil (instruction too short for markImm)", marks)
+	}
+}
+
+func TestInstPatternStopsAtInstructionBoundary(t *testing.T) {
+	// matchStart decodes from exactly the offset it is given: a pattern
+	// matching only "xor %edi,%edi" must not match at offset 0, where the
+	// preceding push instruction starts, and must match at offset 1, the
+	// instruction boundary where the xor starts.
+	p := insts(step(x86asm.XOR))
+	if marks := p.matchStart(instPatternTestCode, 0); marks != nil {
+		t.Fatalf("matchStart at offset 0 = %v, want nil (that's the push instruction)", marks)
+	}
+	marks := p.matchStart(instPatternTestCode, 1)
+	if marks == nil {
+		t.Fatalf("matchStart at offset 1 = nil, want a match (that's the xor instruction)")
+	}
+}
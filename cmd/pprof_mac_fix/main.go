@@ -5,6 +5,19 @@
 // pprof_mac_fix applies a binary patch to the OS X kernel in order to make
 // pprof profiling report accurate values.
 //
+// The set of kernel versions it knows how to patch is built in, but can be
+// extended without rebuilding by passing -fixes=patterns.json, a JSON file
+// of additional fix definitions; see fixFile in fixload.go for the schema,
+// and run "pprof_mac_fix -dump oldkernel" for the disassembly needed to
+// write one.
+//
+// The built-in amd64 patterns are matched against the decoded x86
+// instruction stream (see instPattern in instpattern.go), using
+// golang.org/x/arch/x86/x86asm, rather than against raw bytes; this keeps
+// the patterns readable as instruction sequences and immune to the kind
+// of silent mismatch a masked-byte pattern produces when an immediate
+// changes width or a register allocation shifts an encoding's length.
+//
 // NOTE: This program is not ready for use by others.
 // If you apply this program to your kernel, your system may never boot again.
 // You have been warned.
@@ -25,6 +38,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/arch/x86/x86asm"
 )
 
 var _ time.Time
@@ -50,10 +65,21 @@ func main() {
 		flag.Usage()
 	}
 
+	fixTable := fixes
+	if *fixesFlag != "" {
+		extra, err := loadFixFile(*fixesFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// User-supplied fixes are tried first, so a -fixes file can
+		// override a built-in entry for the same kernel version.
+		fixTable = append(extra, fixTable...)
+	}
+
 	k := loadKernel(flag.Arg(0))
-	fmt.Printf("old: %s\n", k.version)
+	fmt.Printf("old: %s (%s)\n", k.version, k.arch)
 
-	errs := fixAnyVersion(k)
+	applied, errs := fixAnyVersion(k, fixTable)
 	if errs != nil {
 		fmt.Fprintf(os.Stderr, "unrecognized kernel code.\n")
 		for _, err := range errs {
@@ -68,32 +94,59 @@ func main() {
 	copy(k.timestamp, []byte(time.Now().Format("Mon Jan  2 15:04:05 MST 2006")))
 	fmt.Printf("new: %s\n", string(k.version))
 
+	if *verifyFlag {
+		if err := verifyPatched(k, applied.patches); err != nil {
+			log.Fatalf("verify: %v (refusing to write %s)", err, flag.Arg(1))
+		}
+	}
+
 	if err := ioutil.WriteFile(flag.Arg(1), k.data, 0666); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func fixAnyVersion(k *kernel) []error {
+// appliedFix records which fix.apply succeeded and the regions it
+// rewrote, for the benefit of -verify.
+type appliedFix struct {
+	fix     *fix
+	patches []patchRegion
+}
+
+func fixAnyVersion(k *kernel, fixTable []*fix) (*appliedFix, []error) {
 	var errs []error
-	for _, f := range fixes {
-		err := f.apply(k.current_thread, k.bsd_ast)
+	for _, f := range fixTable {
+		// Compared by name, not by pointer: a -fixes entry with a custom
+		// signal_call template gets its own *arch value (see
+		// loadFixFile in fixload.go) rather than reusing
+		// amd64Arch/arm64Arch, so pointer identity can't be used here.
+		if f.arch.name != k.arch.name {
+			continue
+		}
+		patches, err := f.apply(k.current_thread, k.bsd_ast)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("%s: %v", f.version, err))
 			continue
 		}
-		return nil
+		return &appliedFix{fix: f, patches: patches}, nil
 	}
-	return errs
+	if errs == nil {
+		errs = append(errs, fmt.Errorf("no known fixes for %s kernels", k.arch))
+	}
+	return nil, errs
 }
 
 var updateText = `
-For an update, mail rsc@golang.org with the output printed by:
+To add support for this kernel yourself, run:
 	%s -dump %s
+and use the output to write a current_thread/bsd_ast entry in a -fixes
+JSON file (see fixFile in fixload.go). Or mail rsc@golang.org with the
+same -dump output for an update.
 `
 
 type kernel struct {
 	file           string
 	data           []byte
+	arch           *arch
 	version        []byte
 	timestamp      []byte
 	current_thread []byte
@@ -139,20 +192,21 @@ func loadKernel(file string) *kernel {
 	var fat fatHeader
 	binary.Read(bytes.NewReader(data), binary.BigEndian, &fat)
 	if fat.Magic == 0xcafebabe {
-		// It is a fat binary.
+		// It is a fat binary. Use the first slice whose cpu type we
+		// know how to patch.
 		n := int(fat.NumArch)
 		if n > len(fat.Entry) {
 			n = len(fat.Entry)
 		}
 		for i := range fat.Entry[:n] {
 			e := &fat.Entry[i]
-			if e.CPUType == 0x01000007 && e.CPUSubType == 0x00000003 {
-				// x86-64 kernel
+			if a := archForCPU(e.CPUType, e.CPUSubType); a != nil {
+				k.arch = a
 				kdata = data[e.Offset : e.Offset+e.Size]
 				goto HaveKdata
 			}
 		}
-		log.Fatal("cannot find x86-64 kernel in fat kernel binary")
+		log.Fatal("cannot find a supported kernel slice (amd64 or arm64) in fat kernel binary")
 	HaveKdata:
 	}
 
@@ -173,6 +227,14 @@ func loadKernel(file string) *kernel {
 		log.Fatal(err)
 	}
 
+	if k.arch == nil {
+		// Not a fat binary; take the arch straight from the Mach-O header.
+		k.arch = archForCPU(uint32(f.Cpu), f.SubCpu)
+		if k.arch == nil {
+			log.Fatalf("unsupported kernel cpu type %v", f.Cpu)
+		}
+	}
+
 	var syms []*macho.Symbol
 	for i := range f.Symtab.Syms {
 		syms = append(syms, &f.Symtab.Syms[i])
@@ -224,12 +286,31 @@ func dump(k *kernel) {
 var disasRE = regexp.MustCompile(`0x[0-9a-f]+\s+<\w+\+(\d+)>:`)
 
 func dumpDisas(k *kernel, code []byte, name string) {
+	lines, err := disasLines(k, code, name)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if err != nil {
+		log.Printf("warning: %v", err)
+	}
+}
+
+// disasLines runs gdb's "disas name" against k.file and returns the same
+// lines dumpDisas prints -- the raw gdb output interleaved with a hex dump
+// of the underlying bytes for each disassembled range -- so that callers
+// other than dumpDisas (such as the -verify diff) can compare them without
+// reparsing stdout. The returned error is gdb's own run error, if any;
+// dumpDisas only logs it, but -verify's diffDisas treats it as fatal,
+// since a diff built from broken gdb output must not be trusted to gate
+// a write.
+func disasLines(k *kernel, code []byte, name string) ([]string, error) {
+	var out []string
 	cmd := exec.Command("gdb", k.file)
 	cmd.Stdin = strings.NewReader("disas " + name + "\n")
-	disas, err := cmd.CombinedOutput()
-	fmt.Printf("$ gdb %s # disas %s\n", k.file, name)
-	if err != nil {
-		fmt.Printf("running gdb 'disas %s': %v\n", name, err)
+	disas, runErr := cmd.CombinedOutput()
+	out = append(out, fmt.Sprintf("$ gdb %s # disas %s", k.file, name))
+	if runErr != nil {
+		out = append(out, fmt.Sprintf("running gdb 'disas %s': %v", name, runErr))
 	}
 	lines := strings.Split(string(disas), "\n")
 	lastOff := -1
@@ -243,7 +324,7 @@ func dumpDisas(k *kernel, code []byte, name string) {
 			if n > 20 {
 				n = 20
 			}
-			fmt.Printf("\t% x\n", code[lastOff:lastOff+n])
+			out = append(out, fmt.Sprintf("\t% x", code[lastOff:lastOff+n]))
 		}
 		lastOff = off
 	}
@@ -255,11 +336,18 @@ func dumpDisas(k *kernel, code []byte, name string) {
 			n, _ := strconv.Atoi(m[1])
 			flush(n)
 		}
-		fmt.Printf("%s\n", line)
+		out = append(out, line)
 	}
 	flush(-1)
+	return out, runErr
 }
 
+// pattern matches raw bytes against per-nibble masks. It is the original
+// matcher this package used for every architecture; the built-in amd64
+// fixes have since moved to the decoder-based instPattern (instpattern.go),
+// but pattern is still what the arm64 fix and any -fixes JSON file use,
+// since there is neither an x86asm-style decoder for arm64 here nor a
+// convenient JSON spelling for an instPattern.
 type pattern struct {
 	mark    []int
 	mask    []byte
@@ -269,7 +357,23 @@ type pattern struct {
 
 var commentRE = regexp.MustCompile(`//[^\n]*`)
 
+// mustCompile is like compilePattern but exits (via log.Fatal) on a bad
+// pattern; it is used only for the patterns built into the binary, which
+// are never wrong unless pprof_mac_fix itself is.
 func mustCompile(text string) *pattern {
+	p, err := compilePattern(text)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+// compilePattern parses the mark/value/mask text format used by the arm64
+// fix in arm64_fix_table.go and in -fixes pattern files: whitespace-separated fields that
+// are either "*" (record a mark at the current offset) or a byte value,
+// optionally followed by "/mask" (default mask 0xff). "//" begins a
+// comment that runs to the end of the line.
+func compilePattern(text string) (*pattern, error) {
 	p := new(pattern)
 	text = commentRE.ReplaceAllString(text, "")
 	for _, f := range strings.Fields(text) {
@@ -284,11 +388,11 @@ func mustCompile(text string) *pattern {
 		}
 		v, err := strconv.ParseUint(val, 0, 8)
 		if err != nil {
-			log.Fatalf("invalid value %s", f)
+			return nil, fmt.Errorf("invalid value %s", f)
 		}
 		m, err := strconv.ParseUint(mask, 0, 8)
 		if err != nil {
-			log.Fatalf("invalid value %s", f)
+			return nil, fmt.Errorf("invalid mask %s", f)
 		}
 		p.value = append(p.value, byte(v))
 		p.mask = append(p.mask, byte(m))
@@ -298,7 +402,7 @@ func mustCompile(text string) *pattern {
 		i++
 	}
 	p.leading = p.value[:i]
-	return p
+	return p, nil
 }
 
 func (p *pattern) findAll(data []byte) []int {
@@ -347,17 +451,26 @@ func (p *pattern) matchStart(data []byte, off int) []int {
 }
 
 type fix struct {
+	arch           *arch
 	version        string
-	current_thread *pattern
-	bsd_ast        []*pattern
+	current_thread bsdPattern
+	bsd_ast        []bsdPattern
 }
 
 var le = binary.LittleEndian
 
-func (f *fix) apply(current_thread []byte, bsd_ast []byte) error {
+// patchRegion records one byte range that fix.apply rewrote, so that
+// -verify can re-check after the fact that the bytes it wrote are still
+// the bytes actually present in the patched kernel.
+type patchRegion struct {
+	offset int    // offset within bsd_ast
+	want   []byte // the bytes apply wrote at that offset
+}
+
+func (f *fix) apply(current_thread []byte, bsd_ast []byte) ([]patchRegion, error) {
 	m := f.current_thread.matchStart(current_thread, 0)
 	if m == nil {
-		return fmt.Errorf("cannot match current_thread")
+		return nil, fmt.Errorf("cannot match current_thread")
 	}
 	tlsOff := binary.LittleEndian.Uint32(current_thread[m[0]:])
 
@@ -371,14 +484,16 @@ func (f *fix) apply(current_thread []byte, bsd_ast []byte) error {
 
 	if total != 2 {
 		if total == 0 {
-			return fmt.Errorf("cannot match bsd_ast timer call")
+			return nil, fmt.Errorf("cannot match bsd_ast timer call")
 		}
 		if total == 1 {
-			return fmt.Errorf("1 match for bsd_ast timer call %v, want 2", timers)
+			return nil, fmt.Errorf("1 match for bsd_ast timer call %v, want 2", timers)
 		}
-		return fmt.Errorf("%d matches for bsd_ast timer call %v, want 2", total, timers)
+		return nil, fmt.Errorf("%d matches for bsd_ast timer call %v, want 2", total, timers)
 	}
 
+	rw := f.arch.rewriter
+
 	var replace [][]byte
 	for i, timer1 := range timers {
 		for _, timer := range timer1 {
@@ -387,16 +502,10 @@ func (f *fix) apply(current_thread []byte, bsd_ast []byte) error {
 			m = p.matchStart(old, 0)
 			if m == nil {
 				// shouldn't happen - we found the offset above
-				return fmt.Errorf("cannot match bsd_ast timer")
+				return nil, fmt.Errorf("cannot match bsd_ast timer")
 			}
 			if !bytes.Equal(old[m[0]:m[1]], old[m[2]:m[3]]) {
-				return fmt.Errorf("bsd_ast timer sequences differ")
-			}
-			if old[m[0]-2]&0xF8 != 0x70 {
-				return fmt.Errorf("bsd_ast timer sequence missing conditional jump %x", old[m[0]-2])
-			}
-			if old[m[2]-2] != 0xeb {
-				return fmt.Errorf("bsd_ast timer sequence missing unconditional jump %x", old[m[2]-2])
+				return nil, fmt.Errorf("bsd_ast timer sequences differ")
 			}
 
 			var new []byte
@@ -405,180 +514,184 @@ func (f *fix) apply(current_thread []byte, bsd_ast []byte) error {
 			// Last instruction is cond jump over call sequence.
 			// We moved old[m[0]:m[1]] out,
 			// so the jump must be shortened.
-			new[len(new)-1] -= byte(m[1] - m[0])
+			if err := rw.shortenCondJump(new, m[1]-m[0]); err != nil {
+				return nil, fmt.Errorf("bsd_ast timer sequence missing conditional jump: %v", err)
+			}
 			// "If" body.
 			// The call instruction hasn't moved, so it's still correct.
 			// The jmp at the end skips the else body,
 			// so it must be shortened.
 			new = append(new, old[m[1]:m[2]]...)
-			new[len(new)-1] -= byte(m[1] - m[0])
+			if err := rw.shortenUncondJump(new, m[1]-m[0]); err != nil {
+				return nil, fmt.Errorf("bsd_ast timer sequence missing unconditional jump: %v", err)
+			}
 			// "Else" body.
 			// The call instruction has moved, so the offset must be adjusted.
 			new = append(new, old[m[3]:m[4]]...)
-			le.PutUint32(new[len(new)-4:], le.Uint32(new[len(new)-4:])-uint32(len(new)-m[4]))
+			if err := rw.adjustCallDisp(new, len(new)-m[4]); err != nil {
+				return nil, fmt.Errorf("bsd_ast timer sequence missing call: %v", err)
+			}
 			// Set up arguments to psignal_internal.
-			new = append(new,
-				// xor %edi, %edi
-				0x31, 0xff,
-				// xor %esi, %esi
-				0x31, 0xf6,
-				// mov %gs:threadTLS, %rdx
-				0x65, 0x48, 0x8b, 0x14, 0x25,
-				byte(tlsOff), byte(tlsOff>>8), byte(tlsOff>>16), byte(tlsOff>>24),
-				// mov $4, %ecx
-				0xb9, 0x04, 0x00, 0x00, 0x00,
-				// mov $0x1a (or $0x1b), %r8d
-				0x41, 0xb8, old[m[5]], 0x00, 0x00, 0x00,
-			)
+			new = append(new, rw.signalCall(tlsOff, old[m[5]])...)
 			for len(new) < m[6] {
-				new = append(new, 0x90) // nop
+				new = append(new, rw.nop()...)
 			}
 			if len(new) > m[6] {
-				return fmt.Errorf("bsd_ast timer sequence rewrite too long")
+				return nil, fmt.Errorf("bsd_ast timer sequence rewrite too long")
 			}
 			replace = append(replace, new)
 		}
 	}
 
 	// Commit rewrite.
+	var patches []patchRegion
 	n := 0
 	for _, timer1 := range timers {
 		for _, timer := range timer1 {
 			copy(bsd_ast[timer:], replace[n])
+			patches = append(patches, patchRegion{offset: timer, want: replace[n]})
 			n++
 		}
 	}
 
-	return nil
+	return patches, nil
 }
 
 // Darwin 10.8.0 (Snow Leopard)
+//
+// These patterns are expressed as x86asm instruction sequences (see
+// instpattern.go) rather than masked byte literals: each line below names
+// the opcode instPattern expects to decode next, and "mark"/"markImm"
+// record offsets the same way a "*" did in the old mustCompile literals,
+// but anchored to instruction boundaries found by the decoder instead of
+// to a hand-counted byte offset.
+
+var current_thread_leave = insts(
+	step(x86asm.PUSH),       //  push %rbp
+	step(x86asm.MOV),        //  mov %rsp, %rbp
+	markImmStep(x86asm.MOV), //  mov %gs:tlsOff, %rax  (tlsOff is the trailing disp32)
+	step(x86asm.LEAVE),      //  leaveq
+	step(x86asm.RET),        //  retq
+)
+
+var bsd_ast_10_8_0_a = insts(
+	step(x86asm.CMP),         // cmpq $0x0,0x1b0(%r12)
+	step(x86asm.JNE),         // jne
+	step(x86asm.MOV),         // mov 0x1b8(%r12),%eax
+	step(x86asm.TEST),        // test %eax,%eax
+	step(x86asm.JE),          // je
+	markStep(x86asm.MOV),     // mov 0x18(%r12),%rdi           -> m0
+	step(x86asm.MOV),         // mov $0x1,%esi
+	markStep(x86asm.CALL),    // call task_vtimer_set          -> m1
+	step(x86asm.JMP),         // jmp
+	markStep(x86asm.MOV),     // mov 0x18(%r12),%rdi           -> m2
+	step(x86asm.MOV),         // mov $0x1,%esi
+	markStep(x86asm.CALL),    // call task_vtimer_clear        -> m3
+	markBothStep(x86asm.MOV), // mov $0x1a,%r8d                -> m4, m5
+	step(x86asm.XOR),         // xor %ecx,%ecx
+	step(x86asm.XOR),         // xor %edx,%edx
+	step(x86asm.XOR),         // xor %esi,%esi
+	step(x86asm.MOV),         // mov %r12,%rdi
+	markStep(x86asm.CALL),    // call psignal_internal         -> m6
+)
 
-var current_thread_leave = mustCompile(`
-    0x55                            //  0   push %rbp
-    0x48 0x89 0xe5                  //  1   mov %rsp, %rbp
-    0x65 0x48 0x8b 0x04 0x25        //  4   mov %gs:0x8 %rax
-    * 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
-    0xc9                            // 13   leaveq
-    0xc3                            // 14   retq
-`)
-
-var bsd_ast_10_8_0_a = mustCompile(`
-    0x49 0x83 0xbc 0x24 0x00/0x0f 0x01 0x00 0x00 0x00  //  0 cmpq $0x0,0x1b0(%r12)
-    0x75 0x0c                                          //  9 jne +12 [23]
-    0x41 0x8b 0x84 0x24 0x08/0x0f 0x01 0x00 0x00       // 11 mov 0x1b8(%r12),%eax
-    0x85 0xc0                                          // 19 test %eax,%eax
-    0x74 0x11                                          // 21 je +17 [40]
-    * 0x49 0x8b 0x7c 0x24 0x18                         // 23 mov 0x18(%r12),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                    // 28 mov $0x1,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 33 call task_vtimer_set
-    0xeb 0x0f                                          // 38 jmp +15 [55]
-    * 0x49 0x8b 0x7c 0x24 0x18                         // 40 mov 0x18(%r12),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                    // 45 mov $0x1,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 50 call task_vtimer_clear
-    * 0x41 0xb8 * 0x1a/0xfe 0x00 0x00 0x00             // 55 mov $0x1a,%r8d
-    0x31 0xc9                                          // 61 xor %ecx,%ecx
-    0x31 0xd2                                          // 63 xor %edx,%edx
-    0x31 0xf6                                          // 65 xor %esi,%esi
-    0x4c 0x89 0xe7 *                                   // 67 mov %r12,%rdi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 70 call psignal_internal
-`)
-
-var bsd_ast_10_8_0_b = mustCompile(`
-    0x49 0x83 0xbc 0x24 0x00/0x0f 0x01 0x00 0x00 0x00  //  0 cmpq $0x0,0x1d0(%r12)
-    0x75 0x0d                                          //  9 jne +13
-    0x45 0x8b 0x9c 0x24 0x08/0x0f 0x01 0x00 0x00       // 11 mov 0x1d8(%r12),%r11d
-    0x45 0x85 0xdb                                     // 19 test %r11d,%r11d
-    0x74 0x11                                          // 21 je +17
-    * 0x49 0x8b 0x7c 0x24 0x18                         // 23 mov 0x18(%r12),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                    // 28 mov $0x2,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 33 call task_vtimer_set
-    0xeb 0x0f                                          // 38 jmp +15
-    * 0x49 0x8b 0x7c 0x24 0x18                         // 40 mov 0x18(%r12),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                    // 45 mov $0x2,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 50 call task_vtimer_clear
-    * 0x41 0xb8 * 0x1a/0xfe 0x00 0x00 0x00             // 55 mov $0x1b,%r8d
-    0x31 0xc9                                          // 61 xor %ecx,%ecx
-    0x31 0xd2                                          // 63 xor %edx,%edx
-    0x31 0xf6                                          // 65 xor %esi,%esi
-    0x4c 0x89 0xe7 *                                   // 67 mov %r12,%rdi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00       // 70 call psignal_internal
-`)
+var bsd_ast_10_8_0_b = insts(
+	step(x86asm.CMP),         // cmpq $0x0,0x1d0(%r12)
+	step(x86asm.JNE),         // jne
+	step(x86asm.MOV),         // mov 0x1d8(%r12),%r11d
+	step(x86asm.TEST),        // test %r11d,%r11d
+	step(x86asm.JE),          // je
+	markStep(x86asm.MOV),     // mov 0x18(%r12),%rdi           -> m0
+	step(x86asm.MOV),         // mov $0x2,%esi
+	markStep(x86asm.CALL),    // call task_vtimer_set          -> m1
+	step(x86asm.JMP),         // jmp
+	markStep(x86asm.MOV),     // mov 0x18(%r12),%rdi           -> m2
+	step(x86asm.MOV),         // mov $0x2,%esi
+	markStep(x86asm.CALL),    // call task_vtimer_clear        -> m3
+	markBothStep(x86asm.MOV), // mov $0x1b,%r8d                -> m4, m5
+	step(x86asm.XOR),         // xor %ecx,%ecx
+	step(x86asm.XOR),         // xor %edx,%edx
+	step(x86asm.XOR),         // xor %esi,%esi
+	step(x86asm.MOV),         // mov %r12,%rdi
+	markStep(x86asm.CALL),    // call psignal_internal         -> m6
+)
 
 var fix_10_8_0 = fix{
+	amd64Arch,
 	"10.8.0",
 	current_thread_leave,
-	[]*pattern{bsd_ast_10_8_0_a, bsd_ast_10_8_0_b},
+	[]bsdPattern{bsd_ast_10_8_0_a, bsd_ast_10_8_0_b},
 }
 
 // Darwin 11.4.2 (Lion)
 
-var current_thread_pop = mustCompile(`
-    0x55                            //  0   push %rbp
-    0x48 0x89 0xe5                  //  1   mov %rsp, %rbp
-    0x65 0x48 0x8b 0x04 0x25        //  4   mov %gs:0x8 %rax
-    * 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00
-    0x5d                            // 13   pop %rbp
-    0xc3                            // 14   retq
-    0x90                            // 15   nop
-`)
-
-var bsd_ast_11_4_2 = mustCompile(`
-    0x49 0x83 0xbe 0xc0/0xdf 0x01 0x00 0x00 0x00    //  0 cmpq   $0x0,0x1c0(%r14)
-    0x75 0x0a                                       //  8 jne    +10
-    0x41 0x83 0xbe 0xc8/0xdf 0x01 0x00 0x00 0x00    // 10 cmpl   $0x0,0x1c8(%r14)
-    0x74 0x10                                       // 18 je     +16
-    * 0x49 0x8b 0x7e 0x18                           // 20 mov    0x18(%r14),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                 // 24 mov    $0x1,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 29 call task_vtimer_set
-    0xeb 0x0e                                       // 34 jmp    +15
-    * 0x49 0x8b 0x7e 0x18                           // 36 mov    0x18(%r14),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                 // 40 mov    $0x1,%esi
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 45 call task_vtimer_clear
-    * 0x31 0xf6                                     // 50 xor    %esi,%esi
-    0x31 0xc9                                       // 52 xor    %ecx,%ecx
-    0x41 0xb8 * 0x1a/0xfe 0x00 0x00 0x00            // 54 mov    $0x1a,%r8d
-    0x4c 0x89 0xf7                                  // 60 mov    %r14,%rdi
-    0x31 0xd2 *                                     // 63 xor    %edx,%edx
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 65 call psignal_internal
-`)
+var current_thread_pop = insts(
+	step(x86asm.PUSH),       //  push %rbp
+	step(x86asm.MOV),        //  mov %rsp, %rbp
+	markImmStep(x86asm.MOV), //  mov %gs:tlsOff, %rax  (tlsOff is the trailing disp32)
+	step(x86asm.POP),        //  pop %rbp
+	step(x86asm.RET),        //  retq
+)
+
+var bsd_ast_11_4_2 = insts(
+	step(x86asm.CMP),        // cmpq $0x0,0x1c0(%r14)
+	step(x86asm.JNE),        // jne
+	step(x86asm.CMP),        // cmpl $0x0,0x1c8(%r14)
+	step(x86asm.JE),         // je
+	markStep(x86asm.MOV),    // mov 0x18(%r14),%rdi           -> m0
+	step(x86asm.MOV),        // mov $0x1,%esi
+	markStep(x86asm.CALL),   // call task_vtimer_set          -> m1
+	step(x86asm.JMP),        // jmp
+	markStep(x86asm.MOV),    // mov 0x18(%r14),%rdi           -> m2
+	step(x86asm.MOV),        // mov $0x1,%esi
+	markStep(x86asm.CALL),   // call task_vtimer_clear        -> m3
+	markStep(x86asm.XOR),    // xor %esi,%esi                 -> m4
+	step(x86asm.XOR),        // xor %ecx,%ecx
+	markImmStep(x86asm.MOV), // mov $0x1a,%r8d                -> m5
+	step(x86asm.MOV),        // mov %r14,%rdi
+	step(x86asm.XOR),        // xor %edx,%edx
+	markStep(x86asm.CALL),   // call psignal_internal         -> m6
+)
 
 var fix_11_4_2 = fix{
+	amd64Arch,
 	"11.4.2",
 	current_thread_pop,
-	[]*pattern{bsd_ast_11_4_2},
+	[]bsdPattern{bsd_ast_11_4_2},
 }
 
 // Darwin 12.4.0 (Mountain Lion)
 
 var fix_12_4_0 = fix{
+	amd64Arch,
 	"12.4.0",
 	current_thread_pop,
-	[]*pattern{bsd_ast_12_4_0},
+	[]bsdPattern{bsd_ast_12_4_0},
 }
 
-var bsd_ast_12_4_0 = mustCompile(`
-    0x49 0x83 0xbf 0xc0/0xdf 0x01 0x00 0x00 0x00    //  0   cmpq $0x0, 0x1c0(%r15) [or 0x1e0]
-    0x75 0x0a                                       //  8   jne +10 [20]
-    0x41 0x83 0xbf 0xc8/0xdf 0x01 0x00 0x00 0x00    // 10   cmpl $0x0, 0x1c8(%r15) [or 0x1e8]
-    0x74 0x10                                       // 18   je +16 [36]
-    * 0x49 0x8b 0x7f 0x18                           // 20   mov 0x18(%r15),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                 // 24   mov $0x1, %esi [or $0x2]
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 29   call task_vtimer_set
-    0xeb 0x0e                                       // 34   jmp +14 [50]
-    * 0x49 0x8b 0x7f 0x18                           // 36   mov 0x18(%r15),%rdi
-    0xbe 0x00/0xfc 0x00 0x00 0x00 *                 // 40   mov $0x1, %esi [or $0x2]
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 45   call task_vtimer_clear
-    * 0x4c 0x89 0xff                                // 50   mov %r15, %rdi
-    0x31 0xf6                                       // 53   xor %esi, %esi
-    0x31 0xd2                                       // 55   xor %edx, %edx
-    0x31 0xc9                                       // 57   xor %ecx, %ecx
-    0x41 0xb8 * 0x1a/0xfe 0x00 0x00 0x00 *          // 59   mov $0x1a, %r8d [or $0x1b]
-    0xe8 0x00/0x00 0x00/0x00 0x00/0x00 0x00/0x00    // 65   call psignal_internal
-`)
+var bsd_ast_12_4_0 = insts(
+	step(x86asm.CMP),        // cmpq $0x0, 0x1c0(%r15) [or 0x1e0]
+	step(x86asm.JNE),        // jne
+	step(x86asm.CMP),        // cmpl $0x0, 0x1c8(%r15) [or 0x1e8]
+	step(x86asm.JE),         // je
+	markStep(x86asm.MOV),    // mov 0x18(%r15),%rdi           -> m0
+	step(x86asm.MOV),        // mov $0x1, %esi [or $0x2]
+	markStep(x86asm.CALL),   // call task_vtimer_set          -> m1
+	step(x86asm.JMP),        // jmp
+	markStep(x86asm.MOV),    // mov 0x18(%r15),%rdi           -> m2
+	step(x86asm.MOV),        // mov $0x1, %esi [or $0x2]
+	markStep(x86asm.CALL),   // call task_vtimer_clear        -> m3
+	markStep(x86asm.MOV),    // mov %r15, %rdi                -> m4
+	step(x86asm.XOR),        // xor %esi, %esi
+	step(x86asm.XOR),        // xor %edx, %edx
+	step(x86asm.XOR),        // xor %ecx, %ecx
+	markImmStep(x86asm.MOV), // mov $0x1a, %r8d [or $0x1b]    -> m5
+	markStep(x86asm.CALL),   // call psignal_internal         -> m6
+)
 
 var fixes = []*fix{
 	&fix_10_8_0,
 	&fix_11_4_2,
 	&fix_12_4_0,
-}
\ No newline at end of file
+	&fix_20_1_0_arm64,
+}
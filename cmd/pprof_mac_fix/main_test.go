@@ -0,0 +1,98 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// TestFixApplyAmd64 builds a synthetic current_thread/bsd_ast instruction
+// stream matching the real current_thread_pop/bsd_ast_11_4_2 patterns (the
+// fix_11_4_2 entry) and confirms fix.apply still produces a rewrite: that
+// the chunk0-4 decoder-based matcher refactor didn't change what the
+// built-in amd64 fixes actually match or how they get rewritten.
+//
+// The operand encodings below aren't the literal kernel bytes (those are
+// only available by disassembling a real kernel); what matters is that
+// each instruction decodes to the x86asm.Op bsd_ast_11_4_2's steps expect,
+// in the right order and with the right lengths, so the mark offsets
+// line up the same way they do against the real kernel code.
+func TestFixApplyAmd64(t *testing.T) {
+	const sig = 0x1a
+
+	// push %rbp; mov %rsp,%rbp; mov %gs:tlsOff,%rax; pop %rbp; ret
+	const tlsOff = 0x0001b000
+	currentThread := []byte{
+		0x55,             // push %rbp
+		0x48, 0x89, 0xe5, // mov %rsp,%rbp
+		0x65, 0x48, 0x8b, 0x04, 0x25, 0, 0, 0, 0, // mov %gs:tlsOff,%rax
+		0x5d, // pop %rbp
+		0xc3, // ret
+	}
+	le.PutUint32(currentThread[9:], tlsOff)
+
+	timerBody := func(sig byte) []byte {
+		code := []byte{
+			0x3d, 0, 0, 0, 0, // cmp $0,%eax
+			0x75, 0x00, // jne
+			0x3d, 0, 0, 0, 0, // cmp $0,%eax
+			0x74, 0x00, // je
+			0x89, 0xc7, // mov %eax,%edi          (if body, m0)
+			0xbe, 1, 0, 0, 0, // mov $1,%esi
+			0xe8, 0, 0, 0, 0, // call task_vtimer_set  (m1)
+			0xeb, 0x00, // jmp
+			0x89, 0xc7, // mov %eax,%edi          (else body, m2)
+			0xbe, 1, 0, 0, 0, // mov $1,%esi
+			0xe8, 0, 0, 0, 0, // call task_vtimer_clear (m3)
+			0x31, 0xf6, // xor %esi,%esi          (m4)
+			0x48, 0x31, 0xc9, // xor %rcx,%rcx
+			0x41, 0xb8, sig, 0, 0, 0, // mov $sig,%r8d    (m5, markImm)
+			0x48, 0xc7, 0xc7, 0, 0, 0, 0, // mov $0,%rdi
+			0x48, 0x31, 0xd2, // xor %rdx,%rdx
+			0xe8, 0, 0, 0, 0, // call psignal_internal (m6)
+		}
+		return code
+	}
+
+	bsdAst := append(timerBody(sig), timerBody(sig)...)
+
+	f := &fix{
+		arch:           amd64Arch,
+		version:        "test",
+		current_thread: current_thread_pop,
+		bsd_ast:        []bsdPattern{bsd_ast_11_4_2},
+	}
+
+	patches, err := f.apply(currentThread, bsdAst)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("got %d patch regions, want 2", len(patches))
+	}
+
+	// In the rewritten region, the "if" body (mov,mov) and the original
+	// prefix (cmp,jne,cmp,je) and the "if" call+jmp and the relocated
+	// call instruction all come before rw.signalCall's output: 7+14+7+5
+	// bytes, matching the instruction lengths in timerBody/the prefix
+	// above.
+	const signalCallAt = 7 + 14 + 7 + 5
+
+	for _, p := range patches {
+		if err := verifyPatchRegion(amd64Arch, p.want); err != nil {
+			t.Errorf("patch at offset %d failed structural verification: %v", p.offset, err)
+		}
+		// The rewrite must still set up the same tlsOff/sig arguments to
+		// psignal_internal that the original call site encoded. Layout
+		// matches amd64Rewriter.signalCall: xor,xor,mov %gs:tlsOff,mov
+		// $4,mov $sig.
+		gotTLSOff := le.Uint32(p.want[signalCallAt+2+2+5:])
+		if gotTLSOff != tlsOff {
+			t.Errorf("patch at offset %d: tlsOff = %#x, want %#x", p.offset, gotTLSOff, tlsOff)
+		}
+		gotSig := p.want[signalCallAt+2+2+9+5+2]
+		if gotSig != sig {
+			t.Errorf("patch at offset %d: sig = %#x, want %#x", p.offset, gotSig, sig)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"debug/macho"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// verifyFlag enables a dry-run / diff mode: re-parse and re-check the
+// patched kernel before writing it, and print a disassembly diff of the
+// changed code. Given the "your system may never boot again" warning in
+// the package doc in main.go, this is meant to be the normal way to apply a fix
+// to anything you actually intend to boot.
+var verifyFlag = flag.Bool("verify", false, "verify the patch by re-disassembling before writing the output file")
+
+// verifyPatched re-parses k.data as Mach-O, then re-decodes every patched
+// region of bsd_ast and confirms it is a whole, valid instruction stream
+// with no instruction straddling past the end of the region -- the thing
+// that actually catches a bad rewrite, since comparing the patched bytes
+// against fix.apply's own record of what it wrote (patchRegion.want) can
+// only ever agree: nothing touches k.bsd_ast between apply and verify.
+// It then prints a disassembly diff of bsd_ast between the original
+// kernel file and the patched bytes, using gdb the same way -dump does.
+//
+// It returns an error, rather than patching up the problem itself, since
+// any mismatch here means the rewrite cannot be trusted and the output
+// file must not be written.
+func verifyPatched(k *kernel, patches []patchRegion) error {
+	if _, err := macho.NewFile(bytes.NewReader(k.data)); err != nil {
+		return fmt.Errorf("patched kernel no longer parses as Mach-O: %v", err)
+	}
+
+	for _, p := range patches {
+		if p.offset < 0 || p.offset+len(p.want) > len(k.bsd_ast) {
+			return fmt.Errorf("patch region [%d:%d] runs past end of bsd_ast (len %d)",
+				p.offset, p.offset+len(p.want), len(k.bsd_ast))
+		}
+		got := k.bsd_ast[p.offset : p.offset+len(p.want)]
+		if !bytes.Equal(got, p.want) {
+			return fmt.Errorf("patch region at bsd_ast+%#x does not match the expected rewrite (got % x, want % x)",
+				p.offset, got, p.want)
+		}
+		if err := verifyPatchRegion(k.arch, got); err != nil {
+			return fmt.Errorf("patch region at bsd_ast+%#x failed structural verification: %v", p.offset, err)
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "pprof_mac_fix_verify")
+	if err != nil {
+		return fmt.Errorf("writing temp file for verification: %v", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	_, werr := tmp.Write(k.data)
+	cerr := tmp.Close()
+	if werr != nil {
+		return fmt.Errorf("writing temp file for verification: %v", werr)
+	}
+	if cerr != nil {
+		return fmt.Errorf("writing temp file for verification: %v", cerr)
+	}
+
+	fmt.Printf("-- verify: bsd_ast disassembly diff (%s vs patched) --\n", k.file)
+	if err := diffDisas(k.file, tmpName, "bsd_ast"); err != nil {
+		return fmt.Errorf("re-disassembling patched kernel: %v", err)
+	}
+	return nil
+}
+
+// verifyPatchRegion re-decodes got, the current bytes of a patched region,
+// and reports an error if they are not a whole number of instructions for
+// arch with none straddling past the end of the region. For amd64 this
+// uses x86asm.Decode directly; arm64 has no decoder available here, so the
+// equivalent check is that the region is a whole number of the fixed
+// 4-byte instruction words the arm64 rewriter always emits.
+func verifyPatchRegion(a *arch, got []byte) error {
+	if a.name != amd64Arch.name {
+		if len(got)%4 != 0 {
+			return fmt.Errorf("region length %d is not a multiple of 4 (not whole arm64 instructions)", len(got))
+		}
+		return nil
+	}
+	for i := 0; i < len(got); {
+		in, err := x86asm.Decode(got[i:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid instruction at offset %d: %v", i, err)
+		}
+		if i+in.Len > len(got) {
+			return fmt.Errorf("instruction at offset %d (length %d) runs past the end of the region (len %d)",
+				i, in.Len, len(got))
+		}
+		i += in.Len
+	}
+	return nil
+}
+
+// diffDisas disassembles name (current_thread or bsd_ast) in both oldFile
+// and newFile and prints only the lines that differ between the two,
+// prefixed "-" for the old kernel and "+" for the new one. It reuses
+// disasLines, so the diff is driven off the same gdb output -dump is, and
+// it fails if gdb itself failed to run -- a diff built from broken gdb
+// output is worse than no diff, and must not let -verify report success.
+func diffDisas(oldFile, newFile, name string) error {
+	oldK := loadKernel(oldFile)
+	newK := loadKernel(newFile)
+
+	var oldCode, newCode []byte
+	switch name {
+	case "current_thread":
+		oldCode, newCode = oldK.current_thread, newK.current_thread
+	case "bsd_ast":
+		oldCode, newCode = oldK.bsd_ast, newK.bsd_ast
+	default:
+		return fmt.Errorf("unknown disassembly target %q", name)
+	}
+
+	oldLines, err := disasLines(oldK, oldCode, name)
+	if err != nil {
+		return fmt.Errorf("disassembling %s: %v", oldFile, err)
+	}
+	newLines, err := disasLines(newK, newCode, name)
+	if err != nil {
+		return fmt.Errorf("disassembling %s: %v", newFile, err)
+	}
+	printDisasDiff(oldLines, newLines)
+	return nil
+}
+
+func printDisasDiff(old, new []string) {
+	n := len(old)
+	if len(new) > n {
+		n = len(new)
+	}
+	changed := false
+	for i := 0; i < n; i++ {
+		var o, w string
+		if i < len(old) {
+			o = old[i]
+		}
+		if i < len(new) {
+			w = new[i]
+		}
+		if o == w {
+			continue
+		}
+		changed = true
+		if o != "" {
+			fmt.Printf("- %s\n", o)
+		}
+		if w != "" {
+			fmt.Printf("+ %s\n", w)
+		}
+	}
+	if !changed {
+		fmt.Println("(no instruction-level changes)")
+	}
+}